@@ -0,0 +1,184 @@
+package autoproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/MeABc/glog"
+	"github.com/cloudflare/golibs/lrucache"
+	"golang.org/x/crypto/ed25519"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "autoproxy"
+)
+
+// SourceConfig describes one remote rule list that feeds the GFWList filter.
+// Several sources of different formats can be combined - e.g. the classic
+// gfwlist.txt alongside a dnsmasq-china-list mirror or an AdGuard blocklist.
+type SourceConfig struct {
+	Format   string // autoproxy, easylist, adguard, dnsmasq-server, hosts, domain-set, plaintext-domain
+	URL      string
+	Filename string
+	Encoding string
+	Expiry   int
+	Action   string // proxy, direct, block
+
+	// Manifest, when Enabled, replaces the direct GET of URL with a
+	// signed-manifest fetch: Manifest.URL points at a small signed text
+	// file naming the real blob, its sha256/size and an ed25519 signature
+	// over it, verified against PublicKey (a base64 ed25519 public key)
+	// before the blob is trusted.
+	Manifest struct {
+		Enabled   bool
+		URL       string
+		PublicKey string
+	}
+}
+
+type Config struct {
+	GFWList struct {
+		Enabled  bool
+		Sources  []SourceConfig
+		Duration int
+		Proxy    struct {
+			Enabled bool
+			URL     string
+		}
+		EnableRemoteDNS bool
+		DNSServer       string
+		Filter          struct {
+			Enabled bool
+			Rule    string
+		}
+
+		// PacFormat selects how the generated PAC encodes the site list:
+		// "legacy" (flat JS object plus a label-stripping loop), "trie" (a
+		// nested JS object mirroring the reverse-domain trie, O(labels)
+		// descent) or "regex-union" (one anchored alternation regex per
+		// action bucket). Empty/"auto" picks by list size - see
+		// choosePacFormat.
+		PacFormat string
+	}
+}
+
+// gfwlistSource is the runtime counterpart of SourceConfig: URL parsed,
+// Expiry/Duration converted to time.Duration and Action resolved.
+type gfwlistSource struct {
+	Format   string
+	URL      *url.URL
+	Filename string
+	Encoding string
+	Expiry   time.Duration
+	Action   Action
+	Manifest manifestSourceConfig
+}
+
+type manifestSourceConfig struct {
+	Enabled   bool
+	URL       string
+	PublicKey ed25519.PublicKey
+}
+
+type gfwlistState struct {
+	Sources   []gfwlistSource
+	Duration  time.Duration
+	Transport *http.Transport
+	PacFormat string
+	Proxy     struct {
+		Enabled bool
+		URL     string
+	}
+}
+
+type Filter struct {
+	Config
+	Store storage.Store
+
+	GFWListEnabled bool
+	GFWList        gfwlistState
+
+	// dialer and dohUpstream back the optional DoH/DoT resolution path for
+	// GFWList.DNSServer; dohUpstream is nil when EnableRemoteDNS is off or
+	// DNSServer names a plain UDP resolver.
+	dialer      *helpers.Dialer
+	dohUpstream *cachedUpstream
+
+	GFWListDomains *GFWListDomains
+
+	GFWListFilterRule  filters.RoundTripFilter
+	GFWListFilterCache lrucache.Cache
+
+	ProxyPacCache lrucache.Cache
+}
+
+func init() {
+	filters.Register(filterName, func() (filters.Filter, error) {
+		filename := filterName + ".json"
+		config := new(Config)
+		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err != nil {
+			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+		}
+		return NewFilter(config)
+	})
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config:         *config,
+		Store:          storage.LookupStoreByFilterName(filterName),
+		GFWListEnabled: config.GFWList.Enabled,
+		ProxyPacCache:  lrucache.NewLRUCache(32),
+	}
+
+	f.GFWList.Duration = time.Duration(config.GFWList.Duration) * time.Second
+	f.GFWList.PacFormat = config.GFWList.PacFormat
+	f.GFWList.Proxy.Enabled = config.GFWList.Proxy.Enabled
+	f.GFWList.Proxy.URL = config.GFWList.Proxy.URL
+
+	for _, s := range config.GFWList.Sources {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		action, err := ParseAction(s.Action)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest := manifestSourceConfig{Enabled: s.Manifest.Enabled, URL: s.Manifest.URL}
+		if manifest.Enabled {
+			pub, err := base64.StdEncoding.DecodeString(s.Manifest.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			manifest.PublicKey = ed25519.PublicKey(pub)
+		}
+
+		f.GFWList.Sources = append(f.GFWList.Sources, gfwlistSource{
+			Format:   s.Format,
+			URL:      u,
+			Filename: s.Filename,
+			Encoding: s.Encoding,
+			Expiry:   time.Duration(s.Expiry) * time.Second,
+			Action:   action,
+			Manifest: manifest,
+		})
+	}
+
+	f.GFWListInit(config)
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
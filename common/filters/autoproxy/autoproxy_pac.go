@@ -1,22 +1,24 @@
 package autoproxy
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha1"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
-	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MeABc/glog"
@@ -33,14 +35,8 @@ const (
 	localhost2 string = "127.0.1.2"
 )
 
-var (
-	pacOnceUpdater sync.Once
-)
-
 func (f *Filter) GFWListInit(config *Config) {
 	if f.GFWListEnabled {
-		var err error
-
 		d0 := &net.Dialer{
 			KeepAlive: 30 * time.Second,
 			Timeout:   8 * time.Second,
@@ -56,32 +52,43 @@ func (f *Filter) GFWListInit(config *Config) {
 			},
 		}
 
-		if config.GFWList.EnableRemoteDNS {
-			d.Resolver.DNSServer = config.GFWList.DNSServer
-			_, _, _, err := helpers.ParseIPPort(config.GFWList.DNSServer)
-			if err != nil {
-				glog.Fatalf("AUTOPROXY: helpers.ParseIPPort(%v) failed", config.GFWList.DNSServer)
-			}
+		tlsConfig := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: false,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
 		}
 
-		for host, ip := range config.Hosts {
-			if host != "" && ip != "" {
-				d.Resolver.Hosts.Set(host, ip, time.Time{})
-			}
+		f.GFWList.Transport = &http.Transport{
+			Dial:                d.Dial,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 8 * time.Second,
 		}
 
-		d.Resolver.DNSExpiry = time.Duration(config.GFWList.Duration) * time.Second
+		f.dialer = d
 
-		f.GFWList.Transport = &http.Transport{
-			Dial: d.Dial,
-			TLSClientConfig: &tls.Config{
-				MinVersion:         tls.VersionTLS12,
-				InsecureSkipVerify: false,
-				ClientSessionCache: tls.NewLRUClientSessionCache(1000),
-			},
-			TLSHandshakeTimeout: 8 * time.Second,
+		if config.GFWList.EnableRemoteDNS {
+			upstream, err := newDNSUpstream(config.GFWList.DNSServer, tlsConfig, f.GFWList.Transport)
+			switch {
+			case err == nil:
+				// DoH/DoT upstream: resolve the hosts we actually need (the
+				// list sources themselves) once up front and keep them fresh
+				// via the same Hosts cache the static config.Hosts entries
+				// use, so RoundTrip never has to know the difference.
+				f.dohUpstream = newCachedUpstream(upstream, f.GFWList.Duration)
+				for _, src := range f.GFWList.Sources {
+					f.refreshDNSUpstreamHost(src.URL.Hostname())
+				}
+			default:
+				d.Resolver.DNSServer = config.GFWList.DNSServer
+				_, _, _, err := helpers.ParseIPPort(config.GFWList.DNSServer)
+				if err != nil {
+					glog.Fatalf("AUTOPROXY: helpers.ParseIPPort(%v) failed", config.GFWList.DNSServer)
+				}
+			}
 		}
 
+		d.Resolver.DNSExpiry = f.GFWList.Duration
+
 		if config.GFWList.Proxy.Enabled {
 			fixedURL1, err := url.Parse(config.GFWList.Proxy.URL)
 			if err != nil {
@@ -99,12 +106,11 @@ func (f *Filter) GFWListInit(config *Config) {
 		}
 
 		f.GFWListDomains = NewGFWListDomains()
-		f.GFWListDomains.mu.Lock()
-		f.GFWListDomains.Domains, err = f.legallyParseGFWList(f.GFWList.Filename)
+		snapshot, err := f.legallyParseGFWList()
 		if err != nil {
 			glog.Fatalf("AUTOPROXY: legallyParseGFWList error: %v", err)
 		}
-		f.GFWListDomains.mu.Unlock()
+		f.GFWListDomains.store(snapshot)
 
 		if config.GFWList.Filter.Enabled {
 			name := config.GFWList.Filter.Rule
@@ -123,26 +129,90 @@ func (f *Filter) GFWListInit(config *Config) {
 			f.GFWListFilterCache = lrucache.NewLRUCache(8192)
 		}
 
-		go pacOnceUpdater.Do(f.pacUpdater)
+		for i := range f.GFWList.Sources {
+			go f.pacUpdater(i)
+		}
 	}
 }
 
+// pacCacheEntry is what ProxyPacCache stores per (Host, Path,
+// gfwlistVersion) key: the fully rendered body plus the metadata needed to
+// answer conditional requests without re-rendering.
+type pacCacheEntry struct {
+	body    string
+	etag    string
+	modTime time.Time
+}
+
+func pacCacheKey(req *http.Request, version uint64) string {
+	return req.Host + "|" + req.URL.Path + "|" + strconv.FormatUint(version, 10)
+}
+
+// pacCacheTTL is the duration ProxyPacCache entries live for, and what
+// Cache-Control: max-age advertises to clients. It mirrors GFWList.Duration
+// when set, falling back to a sane default otherwise.
+func (f *Filter) pacCacheTTL() time.Duration {
+	if f.GFWList.Duration > 0 {
+		return f.GFWList.Duration
+	}
+	return 15 * time.Minute
+}
+
+func (f *Filter) pacCacheHeaders(entry pacCacheEntry) http.Header {
+	h := http.Header{}
+	h.Set("ETag", `"`+entry.etag+`"`)
+	h.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(f.pacCacheTTL()/time.Second)))
+	h.Set("Last-Modified", entry.modTime.UTC().Format(storage.DateFormat))
+	return h
+}
+
+// notModified reports whether req's conditional headers already match
+// entry, i.e. whether a 304 can be returned instead of the full body.
+func notModified(req *http.Request, entry pacCacheEntry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return inm == `"`+entry.etag+`"` || inm == entry.etag
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := time.Parse(storage.DateFormat, ims); err == nil {
+			// Last-Modified is sent with second precision, so compare at
+			// that precision too.
+			return !entry.modTime.Truncate(time.Second).After(t)
+		}
+	}
+	return false
+}
+
 func (f *Filter) ProxyPacRoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 	_, port, err := net.SplitHostPort(req.Host)
 	if err != nil {
 		port = "80"
 	}
 
-	if v, ok := f.ProxyPacCache.Get(req.URL.Path); ok {
-		if s, ok := v.(string); ok {
-			s = fixProxyPac(s, req)
+	var version uint64
+	if f.GFWListEnabled {
+		version = f.GFWListDomains.Version()
+	}
+	cacheKey := pacCacheKey(req, version)
+
+	if v, ok := f.ProxyPacCache.Get(cacheKey); ok {
+		if entry, ok := v.(pacCacheEntry); ok {
+			header := f.pacCacheHeaders(entry)
+			if notModified(req, entry) {
+				return ctx, &http.Response{
+					StatusCode: http.StatusNotModified,
+					Header:     header,
+					Request:    req,
+					Close:      true,
+				}, nil
+			}
+			header.Set("Content-Length", strconv.Itoa(len(entry.body)))
 			return ctx, &http.Response{
 				StatusCode:    http.StatusOK,
-				Header:        http.Header{},
+				Header:        header,
 				Request:       req,
 				Close:         true,
-				ContentLength: int64(len(s)),
-				Body:          ioutil.NopCloser(strings.NewReader(s)),
+				ContentLength: int64(len(entry.body)),
+				Body:          ioutil.NopCloser(strings.NewReader(entry.body)),
 			}, nil
 		}
 	}
@@ -199,43 +269,30 @@ function FindProxyForURL(url, host) {
 	}
 
 	if f.GFWListEnabled {
-		f.GFWListDomains.mu.RLock()
-		io.WriteString(buf, "\nvar sites = {\n")
-		for _, site := range f.GFWListDomains.Domains {
-			io.WriteString(buf, "\""+site+"\":1,\n")
+		snapshot := f.GFWListDomains.snapshot()
+
+		ruleCount := len(snapshot.byAction[ActionProxy]) + len(snapshot.byAction[ActionBlock]) + len(snapshot.exceptions)
+		switch choosePacFormat(f.GFWList.PacFormat, ruleCount) {
+		case "trie":
+			renderSitesTrie(buf, snapshot)
+		case "regex-union":
+			renderSitesRegexUnion(buf, snapshot)
+		default:
+			renderSitesLegacy(buf, snapshot)
 		}
-		f.GFWListDomains.mu.RUnlock()
-		io.WriteString(buf, "\"google.com\":1\n")
-		io.WriteString(buf, "}\n")
-
-		io.WriteString(buf, `
-for (i in whiteList) {
-	delete sites[whiteList[i]];
-}
-function FindProxyForURL(url, host) {
-    if ((p = MyFindProxyForURL(url, host)) != "DIRECT") {
-        return p
-    }
-
-    var lastPos;
-    do {
-        if (sites.hasOwnProperty(host)) {
-            return 'PROXY `+localhost2+`:8087';
-        }
-        lastPos = host.indexOf('.') + 1;
-        host = host.slice(lastPos);
-    } while (lastPos >= 1);
-    return 'DIRECT';
-}`)
 	}
 
-	s := buf.String()
-	f.ProxyPacCache.Set(req.URL.Path, s, time.Now().Add(15*time.Minute))
+	s := fixProxyPac(buf.String(), req)
 
-	s = fixProxyPac(s, req)
+	sum := sha1.Sum([]byte(s))
+	entry := pacCacheEntry{body: s, etag: hex.EncodeToString(sum[:]), modTime: time.Now()}
+	f.ProxyPacCache.Set(cacheKey, entry, time.Now().Add(f.pacCacheTTL()))
+
+	header := f.pacCacheHeaders(entry)
+	header.Set("Content-Length", strconv.Itoa(len(s)))
 	resp = &http.Response{
 		StatusCode:    http.StatusOK,
-		Header:        http.Header{},
+		Header:        header,
 		Request:       req,
 		Close:         true,
 		ContentLength: int64(len(s)),
@@ -245,94 +302,171 @@ function FindProxyForURL(url, host) {
 	return ctx, resp, nil
 }
 
-func (f *Filter) pacUpdater() {
-	// glog.V(2).Infof("start updater for %+v, expiry=%s, duration=%s", f.GFWList.URL.String(), f.GFWList.Expiry, f.GFWList.Duration)
+// pacUpdater runs the update loop for a single GFWList.Sources entry,
+// identified by its index. Each source has its own interval - jittered
+// ±25% so many clients don't stampede the mirror simultaneously, and
+// backed off exponentially (up to 8x the configured Duration) while the
+// source keeps failing - so a slow or broken mirror doesn't hold back the
+// others.
+func (f *Filter) pacUpdater(i int) {
+	src := f.GFWList.Sources[i]
 
-	ticker := time.Tick(f.GFWList.Duration)
-	var r io.Reader
+	interval := f.GFWList.Duration
+	maxInterval := f.GFWList.Duration * 8
 
 	for {
-		select {
-		case <-ticker:
-			glog.V(2).Infof("Begin auto gfwlist(%#v) update...", f.GFWList.URL.String())
-			resp, err := f.Store.Head(f.GFWList.Filename)
-			if err != nil {
-				glog.Warningf("stat gfwlist(%#v) err: %v", f.GFWList.Filename, err)
-				continue
-			}
+		time.Sleep(jitterDuration(interval))
 
-			lm := resp.Header.Get("Last-Modified")
-			if lm == "" {
-				glog.Warningf("gfwlist(%#v) header(%#v) does not contains last-modified", f.GFWList.Filename, resp.Header)
-				continue
+		if err := f.pacUpdateOnce(src); err != nil {
+			glog.Warningf("AUTOPROXY: update gfwlist source(%#v) error: %v", src.Filename, err)
+			interval *= 2
+			if interval > maxInterval {
+				interval = maxInterval
 			}
+			continue
+		}
 
-			modTime, err := time.Parse(storage.DateFormat, lm)
-			if err != nil {
-				glog.Warningf("stat gfwlist(%#v) has parse %#v error: %v", f.GFWList.Filename, lm, err)
-				continue
-			}
+		interval = f.GFWList.Duration
+	}
+}
 
-			if time.Now().Sub(modTime) < f.GFWList.Expiry {
-				glog.V(2).Infof("gfwlist has not updated. update expiry: %v", f.GFWList.Expiry)
-				continue
+// pacUpdateOnce does a single check-and-refresh pass for src: skip if the
+// stored copy is still fresh, otherwise fetch a new one (via the signed
+// manifest when configured, or a direct GET otherwise) and reparse.
+func (f *Filter) pacUpdateOnce(src gfwlistSource) error {
+	f.refreshDNSUpstreamHost(src.URL.Hostname())
+
+	if resp, err := f.Store.Head(src.Filename); err == nil {
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			if modTime, err := time.Parse(storage.DateFormat, lm); err == nil {
+				if time.Now().Sub(modTime) < src.Expiry {
+					glog.V(2).Infof("gfwlist source(%#v) has not updated. update expiry: %v", src.Filename, src.Expiry)
+					return nil
+				}
 			}
 		}
+	}
 
-		glog.Infof("Downloading %#v", f.GFWList.URL.String())
+	glog.Infof("Downloading %#v", src.URL.String())
 
-		req, err := http.NewRequest(http.MethodGet, f.GFWList.URL.String(), nil)
-		if err != nil {
-			glog.Warningf("NewRequest(%#v) error: %v", f.GFWList.URL.String(), err)
-			continue
-		}
+	var data []byte
+	var err error
+	if src.Manifest.Enabled {
+		data, err = f.fetchSourceViaManifest(src)
+	} else {
+		data, err = f.fetchSourceDirect(src)
+	}
+	if err != nil {
+		return err
+	}
 
-		resp, err := f.GFWList.Transport.RoundTrip(req)
-		if err != nil {
-			glog.Warningf("%T.RoundTrip(%#v) error: %v", f.GFWList.Transport, f.GFWList.URL.String(), err.Error())
-			helpers.CloseResponseBody(resp)
-			continue
-		}
+	if _, err := f.Store.Delete(src.Filename); err != nil {
+		return fmt.Errorf("%T.DeleteObject(%#v) error: %v", f.Store, src.Filename, err)
+	}
 
-		r = resp.Body
-		switch f.GFWList.Encoding {
-		case "base64":
-			r = base64.NewDecoder(base64.StdEncoding, r)
-		default:
-			break
-		}
+	if _, err := f.Store.Put(src.Filename, http.Header{}, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		return fmt.Errorf("%T.PutObject(%#v) error: %v", f.Store, src.Filename, err)
+	}
 
-		data, err := ioutil.ReadAll(r)
-		if err != nil {
-			glog.Warningf("ioutil.ReadAll(%T) error: %v", r, err)
-			helpers.CloseResponseBody(resp)
-			continue
-		}
-		resp.Body.Close()
+	snapshot, err := f.legallyParseGFWList()
+	if err != nil {
+		return err
+	}
+	f.GFWListDomains.store(snapshot)
+	f.ProxyPacCache.Clear()
 
-		_, err = f.Store.Delete(f.GFWList.Filename)
-		if err != nil {
-			glog.Warningf("%T.DeleteObject(%#v) error: %v", f.Store, f.GFWList.Filename, err)
-			continue
-		}
+	glog.Infof("Update %#v from %#v OK", src.Filename, src.URL.String())
+	return nil
+}
 
-		_, err = f.Store.Put(f.GFWList.Filename, http.Header{}, ioutil.NopCloser(bytes.NewReader(data)))
-		if err != nil {
-			glog.Warningf("%T.PutObject(%#v) error: %v", f.Store, f.GFWList.Filename, err)
+func (f *Filter) fetchSourceDirect(src gfwlistSource) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, src.URL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("NewRequest(%#v) error: %v", src.URL.String(), err)
+	}
+
+	resp, err := f.GFWList.Transport.RoundTrip(req)
+	if err != nil {
+		helpers.CloseResponseBody(resp)
+		return nil, fmt.Errorf("%T.RoundTrip(%#v) error: %v", f.GFWList.Transport, src.URL.String(), err)
+	}
+	defer resp.Body.Close()
+
+	var r io.Reader = resp.Body
+	if src.Encoding == "base64" {
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadAll(%T) error: %v", r, err)
+	}
+
+	return data, nil
+}
+
+// fetchSourceViaManifest keeps the previously stored blob untouched
+// whenever the manifest can't be fetched, its signature doesn't verify,
+// or the downloaded blob doesn't match the manifest's sha256/size - only
+// a fully verified blob is ever handed back.
+func (f *Filter) fetchSourceViaManifest(src gfwlistSource) ([]byte, error) {
+	info, err := fetchManifest(f.GFWList.Transport, src.Manifest.URL, src.Manifest.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("manifest(%#v): %v", src.Manifest.URL, err)
+	}
+
+	data, err := fetchAndVerifyBlob(f.GFWList.Transport, info)
+	if err != nil {
+		return nil, fmt.Errorf("manifest(%#v): %v", src.Manifest.URL, err)
+	}
+
+	return data, nil
+}
+
+// cidrClauses renders every CIDRRule tagged with action as a JS isInNet(...)
+// alternation, or "false" when there are none for that action.
+func cidrClauses(cidrs []CIDRRule, action Action) string {
+	clauses := make([]string, 0, len(cidrs))
+	for _, c := range cidrs {
+		if c.Action != action {
 			continue
 		}
+		clauses = append(clauses, fmt.Sprintf(`isInNet(host, "%s", "%s")`, c.CIDR.IP.String(), net.IP(c.CIDR.Mask).String()))
+	}
+	if len(clauses) == 0 {
+		return "false"
+	}
+	return strings.Join(clauses, " || ")
+}
 
-		f.GFWListDomains.mu.Lock()
-		f.GFWListDomains.Domains, err = f.legallyParseGFWList(f.GFWList.Filename)
-		if err != nil {
-			glog.Fatalf("AUTOPROXY: legallyParseGFWList error: %v", err)
-		}
-		f.GFWListDomains.mu.Unlock()
+// refreshDNSUpstreamHost resolves host through the configured DoH/DoT
+// upstream and primes the dialer's Hosts cache with the answer, honoring
+// GFWList.Duration as the TTL. A resolve failure just leaves the previous
+// entry (or none) in place, so the dialer transparently falls back to
+// whatever plain DNS resolution the underlying transport would otherwise
+// use.
+func (f *Filter) refreshDNSUpstreamHost(host string) {
+	if f.dohUpstream == nil || host == "" {
+		return
+	}
+
+	ip, err := f.dohUpstream.Resolve(host)
+	if err != nil {
+		glog.Warningf("AUTOPROXY: doh/dot resolve(%#v) error: %v, falling back to plain DNS", host, err)
+		return
+	}
 
-		f.ProxyPacCache.Clear()
+	f.dialer.Resolver.Hosts.Set(host, ip.String(), time.Now().Add(f.GFWList.Duration))
+}
 
-		glog.Infof("Update %#v from %#v OK", f.GFWList.Filename, f.GFWList.URL.String())
+// jitterDuration randomizes d by up to ±25%, so many clients with the same
+// configured Duration don't all hit a mirror at the same instant.
+func jitterDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
 	}
+	delta := float64(d) * 0.25
+	return d + time.Duration((rand.Float64()*2-1)*delta)
 }
 
 func fixProxyPac(s string, req *http.Request) string {
@@ -340,113 +474,173 @@ func fixProxyPac(s string, req *http.Request) string {
 	return r.ReplaceAllString(s, "PROXY "+req.Host)
 }
 
-func parseAutoProxy(r io.Reader) ([]string, error) {
-	scanner := bufio.NewScanner(r)
+// gfwListSnapshot is the immutable result of one parse of every configured
+// source: a trie for fast Match lookups, a Bloom filter fronting it, and
+// the flattened per-action domain lists PAC generation renders directly.
+type gfwListSnapshot struct {
+	trie       *domainTrie
+	bloom      *bloomFilter
+	byAction   map[Action][]string
+	exceptions []string
+	cidrs      []CIDRRule
+}
 
-	sites := make(map[string]struct{}, 0)
+// CIDRRule is a bare IP / CIDR rule parsed out of a source, e.g. the IP
+// literals AutoProxy lists permit alongside domain rules.
+type CIDRRule struct {
+	CIDR   *net.IPNet
+	Action Action
+}
 
-	for scanner.Scan() {
-		s := strings.TrimSpace(scanner.Text())
+// legallyParseGFWList reads every configured source from the store, parses
+// it with the RuleSource matching its Format and merges the result into a
+// single snapshot: a reverse-domain trie (so exceptions can override a
+// parent rule) plus the flattened per-action lists PAC generation needs.
+func (f *Filter) legallyParseGFWList() (*gfwListSnapshot, error) {
+	trie := newDomainTrie()
+	byAction := map[Action]map[string]struct{}{
+		ActionProxy:  {},
+		ActionDirect: {},
+		ActionBlock:  {},
+	}
+	exceptions := make(map[string]struct{})
+	var cidrs []CIDRRule
 
-		if s == "" ||
-			strings.HasPrefix(s, "[") ||
-			strings.HasPrefix(s, "!") ||
-			strings.HasPrefix(s, "||!") ||
-			strings.HasPrefix(s, "@@") {
-			continue
+	total := 0
+	for _, src := range f.GFWList.Sources {
+		resp, err := f.Store.Get(src.Filename)
+		if err != nil {
+			glog.Errorf("GetObject(%#v) error: %v", src.Filename, err)
+			helpers.CloseResponseBody(resp)
+			return nil, err
+		}
+
+		source, err := NewRuleSource(src.Format)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		rules, err := source.Parse(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			glog.Errorf("%T.Parse(%#v) error: %v", source, src.Filename, err)
+			return nil, err
 		}
 
-		switch {
-		case strings.HasPrefix(s, "||"):
-			site := strings.Split(s[2:], "/")[0]
+		for _, rule := range rules {
 			switch {
-			case strings.Contains(site, "*."):
-				parts := strings.Split(site, "*.")
-				site = parts[len(parts)-1]
-			case strings.HasPrefix(site, "*"):
-				parts := strings.SplitN(site, ".", 2)
-				site = parts[len(parts)-1]
-			}
-			sites[site] = struct{}{}
-		case strings.HasPrefix(s, "|http://"):
-			if u, err := url.Parse(s[1:]); err == nil {
-				site := u.Host
-				switch {
-				case strings.Contains(site, "*."):
-					parts := strings.Split(site, "*.")
-					site = parts[len(parts)-1]
-				case strings.HasPrefix(site, "*"):
-					parts := strings.SplitN(site, ".", 2)
-					site = parts[len(parts)-1]
+			case rule.CIDR != nil:
+				if !rule.Exception {
+					cidrs = append(cidrs, CIDRRule{CIDR: rule.CIDR, Action: src.Action})
 				}
-				sites[site] = struct{}{}
-			}
-		case strings.HasPrefix(s, "."):
-			site := strings.Split(strings.Split(s[1:], "/")[0], "*")[0]
-			if strings.HasSuffix(site, ".co") {
-				site += "m"
-			}
-			sites[site] = struct{}{}
-		case !strings.ContainsAny(s, "*"):
-			site := strings.Split(s, "/")[0]
-			if regexp.MustCompile(`^[a-zA-Z0-9\.\_\-]+$`).MatchString(site) {
-				sites[site] = struct{}{}
+			case rule.Domain != "":
+				trie.insert(rule.Domain, src.Action, rule.Exception)
+				if rule.Exception {
+					exceptions[rule.Domain] = struct{}{}
+				} else {
+					byAction[src.Action][rule.Domain] = struct{}{}
+				}
+			default:
+				continue
 			}
+			total++
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	bloom := newBloomFilter(total, 4)
+	flattened := make(map[Action][]string, len(byAction))
+	for action, set := range byAction {
+		sites := make([]string, 0, len(set))
+		for site := range set {
+			sites = append(sites, site)
+			bloom.add(site)
+		}
+		flattened[action] = sites
 	}
 
-	sites1 := make([]string, 0)
-	for s := range sites {
-		sites1 = append(sites1, s)
+	exceptionList := make([]string, 0, len(exceptions))
+	for site := range exceptions {
+		exceptionList = append(exceptionList, site)
 	}
 
-	return sites1, nil
+	return &gfwListSnapshot{
+		trie:       trie,
+		bloom:      bloom,
+		byAction:   flattened,
+		exceptions: exceptionList,
+		cidrs:      cidrs,
+	}, nil
 }
 
-// parse gfwlist.txt to GFWList
-func (f *Filter) legallyParseGFWList(filename string) ([]string, error) {
-	resp, err := f.Store.Get(filename)
-	if err != nil {
-		glog.Errorf("GetObject(%#v) error: %v", filename, err)
-		helpers.CloseResponseBody(resp)
-		return nil, err
-	}
-	defer resp.Body.Close()
+// Match returns the deepest matching rule's action for domain, so that an
+// exception rule on a subdomain overrides the action its parent domain was
+// tagged with. ok is false (with ActionDirect) when neither domain nor any
+// of its parents matched a rule, or when the deepest match is an exception.
+func (cd *GFWListDomains) Match(domain string) (action Action, ok bool) {
+	snapshot := cd.snapshot()
 
-	sites, err := parseAutoProxy(resp.Body)
-	if err != nil {
-		glog.Errorf("parseAutoProxy(%#v) error: %v", filename, err)
-		return nil, err
+	if !snapshot.bloom.mightContainDomain(domain) {
+		return ActionDirect, false
 	}
 
-	sort.Strings(sites)
-
-	return sites, nil
+	action, exception, matched := snapshot.trie.lookup(domain)
+	if !matched || exception {
+		return ActionDirect, false
+	}
+	return action, true
 }
 
+// GFWListDomainsMatch reports whether d (or one of its parent domains) is
+// tagged for proxying in cd. Other filters that merely need a yes/no
+// proxy-or-not answer should use this helper instead of reaching into
+// GFWListDomains directly.
 func GFWListDomainsMatch(d string, cd *GFWListDomains) bool {
 	if d == "" {
 		return false
 	}
 
-	cd.mu.RLock()
-	defer cd.mu.RUnlock()
+	action, ok := cd.Match(d)
+	return ok && action == ActionProxy
+}
 
-	for _, domain := range cd.Domains {
-		if d == domain || strings.HasSuffix(d, "."+domain) {
-			return true
-		}
-	}
-	return false
+// GFWListDomainsExceptions returns every domain carried by an "@@" rule -
+// i.e. a domain that other filters should treat as excluded even if one of
+// its parents matched a proxy/block rule.
+func GFWListDomainsExceptions(cd *GFWListDomains) []string {
+	return cd.snapshot().exceptions
+}
+
+// GFWListDomainsCIDRs returns every bare IP / CIDR rule collected across
+// all sources, so other filters can apply the same IP-based routing the
+// PAC file's isInNet clauses implement.
+func GFWListDomainsCIDRs(cd *GFWListDomains) []CIDRRule {
+	return cd.snapshot().cidrs
+}
+
+type GFWListDomains struct {
+	v       atomic.Value // *gfwListSnapshot
+	version uint64
+}
+
+func (cd *GFWListDomains) store(s *gfwListSnapshot) {
+	cd.v.Store(s)
+	atomic.AddUint64(&cd.version, 1)
+}
+
+func (cd *GFWListDomains) snapshot() *gfwListSnapshot {
+	return cd.v.Load().(*gfwListSnapshot)
+}
+
+// Version returns a counter incremented every time the underlying rule set
+// is swapped in, so callers - the PAC cache key, in particular - can tell
+// whether a previously rendered PAC is still valid.
+func (cd *GFWListDomains) Version() uint64 {
+	return atomic.LoadUint64(&cd.version)
 }
 
 func NewGFWListDomains() *GFWListDomains {
-	g := &GFWListDomains{
-		Domains: nil,
-	}
-	return g
+	cd := &GFWListDomains{}
+	cd.store(&gfwListSnapshot{trie: newDomainTrie(), bloom: newBloomFilter(0, 4), byAction: make(map[Action][]string)})
+	return cd
 }
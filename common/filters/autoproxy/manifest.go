@@ -0,0 +1,157 @@
+package autoproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// manifestInfo is the parsed, signature-verified content of a
+// Config.GFWList.Sources[i].Manifest file: where to fetch the actual list
+// from, and what it must hash to.
+type manifestInfo struct {
+	URL       string
+	SHA256    [sha256.Size]byte
+	Size      int64
+	UpdatedAt time.Time
+}
+
+// fetchManifest downloads manifestURL over transport, verifies its
+// ed25519 signature against publicKey and returns the fields it carries.
+// The manifest is plain "key: value" lines followed by a trailing
+// "signature: <base64>" line; the signature covers every byte that
+// precedes it.
+func fetchManifest(transport *http.Transport, manifestURL string, publicKey ed25519.PublicKey) (*manifestInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseManifest(data, publicKey)
+}
+
+func parseManifest(data []byte, publicKey ed25519.PublicKey) (*manifestInfo, error) {
+	const sigPrefix = "signature:"
+
+	text := string(data)
+	idx := strings.LastIndex(text, sigPrefix)
+	if idx < 0 {
+		return nil, fmt.Errorf("autoproxy: manifest has no %s line", sigPrefix)
+	}
+
+	signed := text[:idx]
+	sigLine := strings.TrimSpace(text[idx+len(sigPrefix):])
+
+	sig, err := base64.StdEncoding.DecodeString(sigLine)
+	if err != nil {
+		return nil, fmt.Errorf("autoproxy: manifest signature is not valid base64: %v", err)
+	}
+
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("autoproxy: manifest public key has wrong size %d", len(publicKey))
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signed), sig) {
+		return nil, fmt.Errorf("autoproxy: manifest signature verification failed")
+	}
+
+	info := &manifestInfo{}
+
+	scanner := bufio.NewScanner(strings.NewReader(signed))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "url":
+			info.URL = value
+		case "sha256":
+			sum, err := hex.DecodeString(value)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("autoproxy: manifest has malformed sha256 %#v", value)
+			}
+			copy(info.SHA256[:], sum)
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("autoproxy: manifest has malformed size %#v", value)
+			}
+			info.Size = size
+		case "updated_at":
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("autoproxy: manifest has malformed updated_at %#v", value)
+			}
+			info.UpdatedAt = t
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if info.URL == "" {
+		return nil, fmt.Errorf("autoproxy: manifest is missing url")
+	}
+
+	return info, nil
+}
+
+// fetchAndVerifyBlob downloads info.URL over transport and verifies its
+// size and SHA-256 digest match what the manifest promised.
+func fetchAndVerifyBlob(transport *http.Transport, info *manifestInfo) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, info.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size > 0 && int64(len(data)) != info.Size {
+		return nil, fmt.Errorf("autoproxy: manifest blob %#v size mismatch: got %d, want %d", info.URL, len(data), info.Size)
+	}
+
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], info.SHA256[:]) {
+		return nil, fmt.Errorf("autoproxy: manifest blob %#v sha256 mismatch", info.URL)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,247 @@
+package autoproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// pacFormatAutoThreshold is the combined proxy+block+exception rule count
+// at or above which "auto" switches from the legacy flat-map PAC to the trie
+// encoding, so small lists keep the simplest, most readable output while
+// large ones (gfwlist.txt is tens of thousands of entries) get the format
+// that avoids repeated hasOwnProperty scans in the browser.
+const pacFormatAutoThreshold = 5000
+
+// choosePacFormat resolves an explicit "legacy"/"trie"/"regex-union"
+// config value, or picks one for "" / "auto" based on ruleCount. Auto only
+// ever chooses between "legacy" and "trie" - "regex-union" has no size
+// regime where it wins over the trie encoding (same O(labels) shape, but a
+// slower RE2 walk per host) and regressions in it are easy to miss since
+// fewer GFWList mirrors exercise it, so it stays opt-in via an explicit
+// PacFormat setting.
+func choosePacFormat(configured string, ruleCount int) string {
+	switch strings.ToLower(strings.TrimSpace(configured)) {
+	case "trie":
+		return "trie"
+	case "regex-union":
+		return "regex-union"
+	case "legacy":
+		return "legacy"
+	default:
+		if ruleCount >= pacFormatAutoThreshold {
+			return "trie"
+		}
+		return "legacy"
+	}
+}
+
+// renderSitesLegacy emits the original flat-JS-object encoding of
+// snapshot: a "sites"/"blocked"/"exceptions" map per bucket plus a
+// FindProxyForURL that strips one label at a time to check membership.
+func renderSitesLegacy(buf *bytes.Buffer, snapshot *gfwListSnapshot) {
+	io.WriteString(buf, "\nvar sites = {\n")
+	for _, site := range snapshot.byAction[ActionProxy] {
+		io.WriteString(buf, "\""+site+"\":1,\n")
+	}
+	io.WriteString(buf, "}\n")
+
+	io.WriteString(buf, "\nvar blocked = {\n")
+	for _, site := range snapshot.byAction[ActionBlock] {
+		io.WriteString(buf, "\""+site+"\":1,\n")
+	}
+	io.WriteString(buf, "}\n")
+
+	io.WriteString(buf, "\nvar exceptions = {\n")
+	for _, site := range snapshot.exceptions {
+		io.WriteString(buf, "\""+site+"\":1,\n")
+	}
+	io.WriteString(buf, "}\n")
+
+	io.WriteString(buf, "\nfunction isInNetProxy(host) {\n    return "+cidrClauses(snapshot.cidrs, ActionProxy)+";\n}\n")
+	io.WriteString(buf, "\nfunction isInNetBlocked(host) {\n    return "+cidrClauses(snapshot.cidrs, ActionBlock)+";\n}\n")
+
+	io.WriteString(buf, `
+for (i in whiteList) {
+	delete sites[whiteList[i]];
+}
+function lookup(table, host) {
+	var lastPos;
+	do {
+		if (table.hasOwnProperty(host)) {
+			return true;
+		}
+		lastPos = host.indexOf('.') + 1;
+		host = host.slice(lastPos);
+	} while (lastPos >= 1);
+	return false;
+}
+function FindProxyForURL(url, host) {
+    if ((p = MyFindProxyForURL(url, host)) != "DIRECT") {
+        return p
+    }
+
+    if (lookup(exceptions, host)) {
+        return 'DIRECT';
+    }
+
+    if (lookup(blocked, host) || isInNetBlocked(host)) {
+        return 'PROXY 127.0.0.1:0';
+    }
+
+    if (lookup(sites, host) || isInNetProxy(host)) {
+        return 'PROXY `+localhost2+`:8087';
+    }
+    return 'DIRECT';
+}`)
+}
+
+// Terminal codes emitted as the "$" property of a trie node serialized by
+// writeTrieJS, and read back by trieMatcherJS.
+const (
+	trieCodeDirect = 0
+	trieCodeProxy  = 1
+	trieCodeBlock  = 2
+)
+
+// writeTrieJS serializes t as a nested JS object literal: each level is
+// keyed by one reverse-order domain label, and a node that terminates a
+// rule carries its outcome under the "$" key ("$" can't collide with a
+// label - domainRe forbids it). Labels are sorted so the output is
+// deterministic across identical snapshots.
+func writeTrieJS(buf *bytes.Buffer, t *domainTrie) {
+	buf.WriteByte('{')
+	if t.terminal {
+		code := trieCodeProxy
+		switch {
+		case t.exception:
+			code = trieCodeDirect
+		case t.action == ActionDirect:
+			code = trieCodeDirect
+		case t.action == ActionBlock:
+			code = trieCodeBlock
+		}
+		fmt.Fprintf(buf, `"$":%d`, code)
+		if len(t.children) > 0 {
+			buf.WriteByte(',')
+		}
+	}
+
+	labels := make([]string, 0, len(t.children))
+	for label := range t.children {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for i, label := range labels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%q:", label)
+		writeTrieJS(buf, t.children[label])
+	}
+	buf.WriteByte('}')
+}
+
+// trieMatcherJS walks a tree serialized by writeTrieJS the same way
+// domainTrie.lookup does: from TLD toward subdomain, remembering the
+// deepest terminal seen so a more specific rule wins.
+const trieMatcherJS = `
+function trieLookup(node, host) {
+	var labels = host.split('.').reverse();
+	var result = -1;
+	for (var i = 0; i < labels.length && node; i++) {
+		node = node[labels[i]];
+		if (!node) break;
+		if (node.hasOwnProperty('$')) {
+			result = node['$'];
+		}
+	}
+	return result;
+}
+`
+
+// renderSitesTrie emits the trie-mode encoding of snapshot: the trie
+// itself, the matcher that descends it, and a FindProxyForURL built on
+// top of that matcher plus the existing CIDR clauses.
+func renderSitesTrie(buf *bytes.Buffer, snapshot *gfwListSnapshot) {
+	io.WriteString(buf, "\nvar siteTrie = ")
+	writeTrieJS(buf, snapshot.trie)
+	io.WriteString(buf, ";\n")
+	io.WriteString(buf, trieMatcherJS)
+
+	io.WriteString(buf, "\nfunction isInNetProxy(host) {\n    return "+cidrClauses(snapshot.cidrs, ActionProxy)+";\n}\n")
+	io.WriteString(buf, "\nfunction isInNetBlocked(host) {\n    return "+cidrClauses(snapshot.cidrs, ActionBlock)+";\n}\n")
+
+	fmt.Fprintf(buf, `
+function FindProxyForURL(url, host) {
+    if ((p = MyFindProxyForURL(url, host)) != "DIRECT") {
+        return p
+    }
+
+    var r = trieLookup(siteTrie, host);
+    if (r === %d) {
+        return 'DIRECT';
+    }
+    if (r === %d || isInNetBlocked(host)) {
+        return 'PROXY 127.0.0.1:0';
+    }
+    if (r === %d || isInNetProxy(host)) {
+        return 'PROXY %s:8087';
+    }
+    return 'DIRECT';
+}`, trieCodeDirect, trieCodeBlock, trieCodeProxy, localhost2)
+}
+
+// regexEscapeDomain escapes the one regex metacharacter a domain label can
+// contain ("." itself), since domainRe otherwise restricts rules to
+// [a-zA-Z0-9._-].
+func regexEscapeDomain(domain string) string {
+	return strings.Replace(domain, ".", `\.`, -1)
+}
+
+// domainRegexUnion returns an anchored alternation matching any of domains
+// or one of their subdomains, or a regex matching nothing when domains is
+// empty (an empty alternative would otherwise match everything).
+func domainRegexUnion(domains []string) string {
+	if len(domains) == 0 {
+		return `(?!)`
+	}
+	escaped := make([]string, len(domains))
+	for i, d := range domains {
+		escaped[i] = regexEscapeDomain(d)
+	}
+	return `(?:^|\.)(?:` + strings.Join(escaped, "|") + `)$`
+}
+
+// renderSitesRegexUnion emits the regex-union mode encoding of snapshot:
+// one anchored alternation regex per action bucket, tested against host
+// directly instead of walking a trie or flat map.
+func renderSitesRegexUnion(buf *bytes.Buffer, snapshot *gfwListSnapshot) {
+	fmt.Fprintf(buf, "\nvar exceptionsRe = /%s/;\n", domainRegexUnion(snapshot.exceptions))
+	fmt.Fprintf(buf, "var blockedRe = /%s/;\n", domainRegexUnion(snapshot.byAction[ActionBlock]))
+	fmt.Fprintf(buf, "var sitesRe = /%s/;\n", domainRegexUnion(snapshot.byAction[ActionProxy]))
+
+	io.WriteString(buf, "\nfunction isInNetProxy(host) {\n    return "+cidrClauses(snapshot.cidrs, ActionProxy)+";\n}\n")
+	io.WriteString(buf, "\nfunction isInNetBlocked(host) {\n    return "+cidrClauses(snapshot.cidrs, ActionBlock)+";\n}\n")
+
+	io.WriteString(buf, `
+function FindProxyForURL(url, host) {
+    if ((p = MyFindProxyForURL(url, host)) != "DIRECT") {
+        return p
+    }
+
+    if (exceptionsRe.test(host)) {
+        return 'DIRECT';
+    }
+    if (blockedRe.test(host) || isInNetBlocked(host)) {
+        return 'PROXY 127.0.0.1:0';
+    }
+    if (sitesRe.test(host) || isInNetProxy(host)) {
+        return 'PROXY `+localhost2+`:8087';
+    }
+    return 'DIRECT';
+}`)
+}
@@ -0,0 +1,205 @@
+package autoproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// runPacBody writes a rendered PAC body plus a small harness that stubs the
+// globals FindProxyForURL expects (MyFindProxyForURL, whiteList) and calls
+// it once per host in hosts, to node and returns the parsed
+// host->FindProxyForURL(...) result map. Skips the calling test if node
+// isn't on PATH.
+func runPacBody(t *testing.T, body []byte, hosts []string) map[string]string {
+	t.Helper()
+	nodePath, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not found on PATH, skipping JS execution")
+	}
+
+	script := new(bytes.Buffer)
+	script.Write(body)
+	script.WriteString("\nvar whiteList = {};\nfunction MyFindProxyForURL(url, host) { return 'DIRECT'; }\n")
+	script.WriteString("var results = {};\n")
+	for _, host := range hosts {
+		encodedHost, _ := json.Marshal(host)
+		script.WriteString("results[" + string(encodedHost) + "] = FindProxyForURL('http://' + " + string(encodedHost) + " + '/', " + string(encodedHost) + ");\n")
+	}
+	script.WriteString("console.log(JSON.stringify(results));\n")
+
+	f, err := os.CreateTemp("", "pac-run-*.js")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(script.Bytes()); err != nil {
+		t.Fatalf("write temp pac file: %v", err)
+	}
+	f.Close()
+
+	cmd := exec.Command(nodePath, f.Name())
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("node run failed: %v\n%s\n--- body ---\n%s", err, stderr.String(), script.String())
+	}
+
+	var results map[string]string
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		t.Fatalf("parse node output %#v: %v", stdout.String(), err)
+	}
+	return results
+}
+
+func TestChoosePacFormat(t *testing.T) {
+	tests := []struct {
+		configured string
+		ruleCount  int
+		want       string
+	}{
+		{"legacy", 100000, "legacy"},
+		{"trie", 1, "trie"},
+		{"regex-union", 1, "regex-union"},
+		{"", 10, "legacy"},
+		{"auto", pacFormatAutoThreshold - 1, "legacy"},
+		{"auto", pacFormatAutoThreshold, "trie"},
+	}
+	for _, tt := range tests {
+		if got := choosePacFormat(tt.configured, tt.ruleCount); got != tt.want {
+			t.Errorf("choosePacFormat(%#v, %d) = %#v, want %#v", tt.configured, tt.ruleCount, got, tt.want)
+		}
+	}
+}
+
+func TestDomainRegexUnionEmpty(t *testing.T) {
+	// "(?!)" is the JS-side idiom for "never matches"; Go's RE2 engine
+	// can't compile it (no lookahead support), so this case is only
+	// checked by construction.
+	if got := domainRegexUnion(nil); got != `(?!)` {
+		t.Fatalf("domainRegexUnion(nil) = %#v, want %#v", got, `(?!)`)
+	}
+}
+
+// TestPacFormatRenderedBodyParses renders each PacFormat mode's real
+// renderSites* output (not a Go reimplementation of its logic) and checks
+// the result is syntactically valid JavaScript via `node --check`, so a
+// codegen bug like a statement emitted outside its enclosing object
+// literal fails on its own, without the stub harness
+// TestPacFormatMatcherEquivalence below appends. Skips if node isn't on
+// PATH.
+func TestPacFormatRenderedBodyParses(t *testing.T) {
+	nodePath, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not found on PATH, skipping JS syntax check")
+	}
+
+	trie := newDomainTrie()
+	trie.insert("example.com", ActionProxy, false)
+	trie.insert("ads.example.net", ActionBlock, false)
+	trie.insert("safe.example.com", ActionProxy, true)
+
+	snapshot := &gfwListSnapshot{
+		trie: trie,
+		byAction: map[Action][]string{
+			ActionProxy: {"example.com"},
+			ActionBlock: {"ads.example.net"},
+		},
+		exceptions: []string{"safe.example.com"},
+	}
+
+	renderers := map[string]func(*bytes.Buffer, *gfwListSnapshot){
+		"legacy":      renderSitesLegacy,
+		"trie":        renderSitesTrie,
+		"regex-union": renderSitesRegexUnion,
+	}
+	for mode, render := range renderers {
+		buf := new(bytes.Buffer)
+		render(buf, snapshot)
+
+		// node --check reads a real path, not a pipe, so the rendered
+		// body goes through a temp file rather than stdin.
+		f, err := os.CreateTemp("", "pac-"+mode+"-*.js")
+		if err != nil {
+			t.Fatalf("CreateTemp: %v", err)
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			t.Fatalf("write temp pac file: %v", err)
+		}
+		f.Close()
+
+		cmd := exec.Command(nodePath, "--check", f.Name())
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			t.Errorf("%s mode emitted invalid JavaScript: %v\n%s\n--- body ---\n%s", mode, err, stderr.String(), buf.String())
+		}
+	}
+}
+
+// TestPacFormatMatcherEquivalence renders the same rule set - including a
+// non-exception "direct" domain, the dnsmasq-china-list case chunk0-1 named
+// - through all three renderSites* implementations and runs each one's
+// real FindProxyForURL in node, so a codegen bug in any single mode (like
+// writeTrieJS previously mis-tagging ActionDirect terminals as PROXY) shows
+// up as a mismatch against the other two rather than being masked by a
+// Go-side reimplementation of the matching logic.
+func TestPacFormatMatcherEquivalence(t *testing.T) {
+	trie := newDomainTrie()
+	trie.insert("example.com", ActionProxy, false)
+	trie.insert("blocked-example.org", ActionProxy, false)
+	trie.insert("ads.example.net", ActionBlock, false)
+	trie.insert("safe.example.com", ActionProxy, true)
+	trie.insert("taobao.cn", ActionDirect, false)
+
+	snapshot := &gfwListSnapshot{
+		trie: trie,
+		byAction: map[Action][]string{
+			ActionProxy: {"example.com", "blocked-example.org"},
+			ActionBlock: {"ads.example.net"},
+		},
+		exceptions: []string{"safe.example.com"},
+	}
+
+	hosts := []string{
+		"www.example.com",
+		"example.com",
+		"safe.example.com",
+		"sub.blocked-example.org",
+		"ads.example.net",
+		"unrelated.test",
+		"taobao.cn",
+		"www.taobao.cn",
+	}
+	want := map[string]string{
+		"www.example.com":         "PROXY " + localhost2 + ":8087",
+		"example.com":             "PROXY " + localhost2 + ":8087",
+		"safe.example.com":        "DIRECT",
+		"sub.blocked-example.org": "PROXY " + localhost2 + ":8087",
+		"ads.example.net":         "PROXY 127.0.0.1:0",
+		"unrelated.test":          "DIRECT",
+		"taobao.cn":               "DIRECT",
+		"www.taobao.cn":           "DIRECT",
+	}
+
+	renderers := map[string]func(*bytes.Buffer, *gfwListSnapshot){
+		"legacy":      renderSitesLegacy,
+		"trie":        renderSitesTrie,
+		"regex-union": renderSitesRegexUnion,
+	}
+	for mode, render := range renderers {
+		buf := new(bytes.Buffer)
+		render(buf, snapshot)
+
+		got := runPacBody(t, buf.Bytes(), hosts)
+		for _, host := range hosts {
+			if got[host] != want[host] {
+				t.Errorf("%s mode: FindProxyForURL(_, %#v) = %#v, want %#v", mode, host, got[host], want[host])
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package autoproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/MeABc/glog"
+)
+
+// dnsUpstream resolves a single hostname to an IPv4/IPv6 address over a
+// transport other than classic UDP DNS, so the gfwlist itself - and any
+// host the PAC filter needs to resolve - can be looked up without
+// depending on local, possibly-poisoned, resolvers.
+type dnsUpstream interface {
+	Resolve(host string) (net.IP, error)
+}
+
+// newDNSUpstream builds a dnsUpstream for server, which may be a DoH URL
+// (https://...), a DoT address (tls://host:port) or empty/anything else,
+// in which case the caller should fall back to plain UDP DNS.
+func newDNSUpstream(server string, tlsConfig *tls.Config, transport *http.Transport) (dnsUpstream, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "https":
+		return &dohResolver{url: server, transport: transport}, nil
+	case "tls":
+		addr := u.Host
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "853")
+		}
+		return &dotResolver{addr: addr, tlsConfig: tlsConfig}, nil
+	default:
+		return nil, fmt.Errorf("autoproxy: %#v is not a doh/dot DNSServer", server)
+	}
+}
+
+func buildDNSQuery(host string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	var id uint16 = 0x1234
+	binary.Write(buf, binary.BigEndian, id)
+	binary.Write(buf, binary.BigEndian, uint16(0x0100)) // RD=1
+	binary.Write(buf, binary.BigEndian, uint16(1))      // QDCOUNT
+	binary.Write(buf, binary.BigEndian, uint16(0))      // ANCOUNT
+	binary.Write(buf, binary.BigEndian, uint16(0))      // NSCOUNT
+	binary.Write(buf, binary.BigEndian, uint16(0))      // ARCOUNT
+
+	for _, label := range splitDNSName(host) {
+		if len(label) > 63 {
+			return nil, fmt.Errorf("autoproxy: dns label too long: %#v", label)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+
+	binary.Write(buf, binary.BigEndian, uint16(1)) // QTYPE A
+	binary.Write(buf, binary.BigEndian, uint16(1)) // QCLASS IN
+
+	return buf.Bytes(), nil
+}
+
+func splitDNSName(host string) []string {
+	labels := make([]string, 0, 4)
+	start := 0
+	for i := 0; i < len(host); i++ {
+		if host[i] == '.' {
+			labels = append(labels, host[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(host) {
+		labels = append(labels, host[start:])
+	}
+	return labels
+}
+
+// parseDNSResponseA extracts the first A record found in a DNS response
+// message, skipping over the (fixed-shape) question section we issued.
+func parseDNSResponseA(data []byte) (net.IP, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("autoproxy: dns response too short")
+	}
+
+	ancount := binary.BigEndian.Uint16(data[6:8])
+	if ancount == 0 {
+		return nil, fmt.Errorf("autoproxy: dns response has no answers")
+	}
+
+	pos := 12
+	// question section: one name + QTYPE(2) + QCLASS(2)
+	for pos < len(data) && data[pos] != 0 {
+		pos += int(data[pos]) + 1
+	}
+	pos += 1 + 4
+
+	for i := uint16(0); i < ancount && pos < len(data); i++ {
+		// NAME (may be a pointer, 0xC0 high bits)
+		if data[pos]&0xC0 == 0xC0 {
+			pos += 2
+		} else {
+			for pos < len(data) && data[pos] != 0 {
+				pos += int(data[pos]) + 1
+			}
+			pos++
+		}
+		if pos+10 > len(data) {
+			break
+		}
+		rtype := binary.BigEndian.Uint16(data[pos : pos+2])
+		rdlength := int(binary.BigEndian.Uint16(data[pos+8 : pos+10]))
+		pos += 10
+		if pos+rdlength > len(data) {
+			break
+		}
+		if rtype == 1 && rdlength == 4 {
+			return net.IP(data[pos : pos+4]), nil
+		}
+		pos += rdlength
+	}
+
+	return nil, fmt.Errorf("autoproxy: dns response has no A record")
+}
+
+// dohResolver speaks DNS-over-HTTPS (RFC 8484) using application/dns-message
+// POST requests, reusing the TLS config and proxy dialer already wired up
+// for the gfwlist download transport.
+type dohResolver struct {
+	url       string
+	transport *http.Transport
+}
+
+func (d *dohResolver) Resolve(host string) (net.IP, error) {
+	query, err := buildDNSQuery(host)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: d.transport, Timeout: 8 * time.Second}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDNSResponseA(data)
+}
+
+// dotResolver speaks DNS-over-TLS (RFC 7858): each message on the TLS
+// stream is prefixed with its 2-byte big-endian length.
+type dotResolver struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (d *dotResolver) Resolve(host string) (net.IP, error) {
+	query, err := buildDNSQuery(host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 8 * time.Second}, "tcp", d.addr, d.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(8 * time.Second))
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(query)))
+	if _, err := conn.Write(length[:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := fullRead(conn, data); err != nil {
+		return nil, err
+	}
+
+	return parseDNSResponseA(data)
+}
+
+func fullRead(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// cachedUpstream adds TTL caching (honoring Duration, as the plain UDP
+// path's LRUCache already does) in front of a dnsUpstream. When the
+// upstream transport breaks it logs a warning and returns the error -
+// callers fall back to plain UDP DNS in that case. Multiple gfwlist sources can share one
+// cachedUpstream, each refreshed from its own pacUpdater goroutine, so
+// cache is guarded by mu rather than assuming single-goroutine access.
+type cachedUpstream struct {
+	upstream dnsUpstream
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedAnswer
+}
+
+type cachedAnswer struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func newCachedUpstream(upstream dnsUpstream, ttl time.Duration) *cachedUpstream {
+	return &cachedUpstream{upstream: upstream, ttl: ttl, cache: make(map[string]cachedAnswer)}
+}
+
+func (c *cachedUpstream) Resolve(host string) (net.IP, error) {
+	c.mu.Lock()
+	a, ok := c.cache[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(a.expires) {
+		return a.ip, nil
+	}
+
+	ip, err := c.upstream.Resolve(host)
+	if err != nil {
+		glog.Warningf("AUTOPROXY: %T.Resolve(%#v) error: %v, falling back to plain DNS", c.upstream, host, err)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[host] = cachedAnswer{ip: ip, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return ip, nil
+}
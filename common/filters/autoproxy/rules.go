@@ -0,0 +1,420 @@
+package autoproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Action is the downstream disposition for a matched rule.
+type Action int
+
+const (
+	ActionProxy Action = iota
+	ActionDirect
+	ActionBlock
+)
+
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "proxy":
+		return ActionProxy, nil
+	case "direct":
+		return ActionDirect, nil
+	case "block":
+		return ActionBlock, nil
+	default:
+		return ActionProxy, fmt.Errorf("autoproxy: unknown action %#v", s)
+	}
+}
+
+func (a Action) String() string {
+	switch a {
+	case ActionDirect:
+		return "direct"
+	case ActionBlock:
+		return "block"
+	default:
+		return "proxy"
+	}
+}
+
+// Rule is a single parsed entry: either a domain (and its subdomains) or a
+// CIDR, and whether it is an exception (overrides a less specific rule of
+// the same or a different source). The parsers in this file leave Action
+// unset; legallyParseGFWList applies the source's configured Action.
+type Rule struct {
+	Domain    string
+	CIDR      *net.IPNet
+	Action    Action
+	Exception bool
+}
+
+// RuleSource turns a raw rule list (as downloaded) into a slice of Rules.
+// One implementation exists per supported list format so that
+// Config.GFWList.Sources can mix formats freely.
+type RuleSource interface {
+	Parse(r io.Reader) ([]Rule, error)
+}
+
+// NewRuleSource returns the RuleSource implementation registered for
+// format, defaulting to the classic AutoProxy format when format is empty.
+func NewRuleSource(format string) (RuleSource, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "autoproxy", "gfwlist":
+		return AutoProxyRuleSource{}, nil
+	case "easylist":
+		return EasyListRuleSource{}, nil
+	case "adguard":
+		return AdGuardRuleSource{}, nil
+	case "dnsmasq-server":
+		return DnsmasqServerRuleSource{}, nil
+	case "hosts":
+		return HostsRuleSource{}, nil
+	case "domain-set":
+		return DomainSetRuleSource{}, nil
+	case "plaintext-domain":
+		return PlaintextDomainRuleSource{}, nil
+	default:
+		return nil, fmt.Errorf("autoproxy: unknown rule source format %#v", format)
+	}
+}
+
+var domainRe = regexp.MustCompile(`^[a-zA-Z0-9\.\_\-]+$`)
+
+func stripWildcard(site string) string {
+	switch {
+	case strings.Contains(site, "*."):
+		parts := strings.Split(site, "*.")
+		return parts[len(parts)-1]
+	case strings.HasPrefix(site, "*"):
+		parts := strings.SplitN(site, ".", 2)
+		return parts[len(parts)-1]
+	default:
+		return site
+	}
+}
+
+// AutoProxyRuleSource parses the classic AutoProxy / gfwlist.txt format:
+// "||domain", "|http://host/...", ".domain", "@@" exceptions and bare IPs;
+// "/regex/" entries are recognized and skipped. Domains that fail domainRe
+// are dropped. It is the format gfwlist.txt itself ships in.
+type AutoProxyRuleSource struct{}
+
+func (AutoProxyRuleSource) Parse(r io.Reader) ([]Rule, error) {
+	scanner := bufio.NewScanner(r)
+
+	rules := make([]Rule, 0)
+
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+
+		if s == "" ||
+			strings.HasPrefix(s, "[") ||
+			strings.HasPrefix(s, "!") ||
+			strings.HasPrefix(s, "||!") {
+			continue
+		}
+
+		exception := false
+		if strings.HasPrefix(s, "@@") {
+			exception = true
+			s = s[2:]
+		}
+
+		switch {
+		case strings.HasPrefix(s, "||"):
+			site := strings.Split(s[2:], "/")[0]
+			site = stripWildcard(site)
+			if domainRe.MatchString(site) {
+				rules = append(rules, Rule{Domain: site, Exception: exception})
+			}
+		case strings.HasPrefix(s, "|http://"):
+			if u, err := parseAutoProxyURL(s[1:]); err == nil {
+				site := stripWildcard(u)
+				if domainRe.MatchString(site) {
+					rules = append(rules, Rule{Domain: site, Exception: exception})
+				}
+			}
+		case strings.HasPrefix(s, "."):
+			site := strings.Split(strings.Split(s[1:], "/")[0], "*")[0]
+			if strings.HasSuffix(site, ".co") {
+				site += "m"
+			}
+			if domainRe.MatchString(site) {
+				rules = append(rules, Rule{Domain: site, Exception: exception})
+			}
+		case strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"):
+			// regex rules are too open-ended to fold into the domain trie;
+			// they are intentionally dropped, same as before.
+			continue
+		case !strings.ContainsAny(s, "*"):
+			if _, ipnet, err := net.ParseCIDR(s); err == nil {
+				rules = append(rules, Rule{CIDR: ipnet, Exception: exception})
+				continue
+			}
+			if ip := net.ParseIP(s); ip != nil {
+				bits := 32
+				if ip.To4() == nil {
+					bits = 128
+				}
+				rules = append(rules, Rule{CIDR: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, Exception: exception})
+				continue
+			}
+			site := strings.Split(s, "/")[0]
+			if domainRe.MatchString(site) {
+				rules = append(rules, Rule{Domain: site, Exception: exception})
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseAutoProxyURL(s string) (string, error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return "", fmt.Errorf("autoproxy: malformed url rule %#v", s)
+	}
+	host := s[i+3:]
+	host = strings.Split(host, "/")[0]
+	host = strings.Split(host, ":")[0]
+	if host == "" {
+		return "", fmt.Errorf("autoproxy: malformed url rule %#v", s)
+	}
+	return host, nil
+}
+
+// EasyListRuleSource parses a subset of the AdBlock/EasyList syntax shared
+// with AutoProxy: "||domain^" style anchors plus "##"/"#@#" cosmetic rules
+// (ignored, they carry no network-level meaning here).
+type EasyListRuleSource struct{}
+
+func (EasyListRuleSource) Parse(r io.Reader) ([]Rule, error) {
+	scanner := bufio.NewScanner(r)
+
+	rules := make([]Rule, 0)
+
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+
+		if s == "" || strings.HasPrefix(s, "!") || strings.Contains(s, "##") || strings.Contains(s, "#@#") {
+			continue
+		}
+
+		exception := false
+		if strings.HasPrefix(s, "@@") {
+			exception = true
+			s = s[2:]
+		}
+
+		if !strings.HasPrefix(s, "||") {
+			continue
+		}
+
+		site := s[2:]
+		site = strings.TrimSuffix(site, "^")
+		site = strings.Split(site, "/")[0]
+		site = strings.Split(site, "^")[0]
+		site = stripWildcard(site)
+		if domainRe.MatchString(site) {
+			rules = append(rules, Rule{Domain: site, Exception: exception})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// AdGuardRuleSource parses AdGuard Home style filter lines, which are a
+// superset of EasyList with "@@||domain^$important"-like modifiers; the
+// modifiers after "$" are ignored for proxy routing purposes.
+type AdGuardRuleSource struct{}
+
+func (AdGuardRuleSource) Parse(r io.Reader) ([]Rule, error) {
+	scanner := bufio.NewScanner(r)
+
+	rules := make([]Rule, 0)
+
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+
+		if s == "" || strings.HasPrefix(s, "!") || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		exception := false
+		if strings.HasPrefix(s, "@@") {
+			exception = true
+			s = s[2:]
+		}
+
+		if !strings.HasPrefix(s, "||") {
+			continue
+		}
+
+		site := s[2:]
+		if i := strings.Index(site, "$"); i >= 0 {
+			site = site[:i]
+		}
+		site = strings.TrimSuffix(site, "^")
+		site = strings.Split(site, "/")[0]
+		site = stripWildcard(site)
+		if domainRe.MatchString(site) {
+			rules = append(rules, Rule{Domain: site, Exception: exception})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// DnsmasqServerRuleSource parses dnsmasq "server=/domain/ip" and
+// "address=/domain/ip" lines, as used by dnsmasq-china-list and similar
+// projects. Only the domain is kept; the ip part is routing metadata we
+// don't need.
+type DnsmasqServerRuleSource struct{}
+
+func (DnsmasqServerRuleSource) Parse(r io.Reader) ([]Rule, error) {
+	scanner := bufio.NewScanner(r)
+
+	rules := make([]Rule, 0)
+
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		for _, prefix := range []string{"server=/", "address=/"} {
+			if !strings.HasPrefix(s, prefix) {
+				continue
+			}
+			rest := s[len(prefix):]
+			parts := strings.SplitN(rest, "/", 2)
+			site := parts[0]
+			if domainRe.MatchString(site) {
+				rules = append(rules, Rule{Domain: site})
+			}
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// HostsRuleSource parses "/etc/hosts" style lines ("ip domain [domain...]"),
+// as used by many blocklists distributed as hosts files.
+type HostsRuleSource struct{}
+
+func (HostsRuleSource) Parse(r io.Reader) ([]Rule, error) {
+	scanner := bufio.NewScanner(r)
+
+	rules := make([]Rule, 0)
+
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		fields := strings.Fields(s)
+		if len(fields) < 2 {
+			continue
+		}
+		if net.ParseIP(fields[0]) == nil {
+			continue
+		}
+
+		for _, site := range fields[1:] {
+			if domainRe.MatchString(site) {
+				rules = append(rules, Rule{Domain: site})
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// DomainSetRuleSource parses Surge/Shadowrocket style "DOMAIN-SET" files:
+// one domain per line, optionally prefixed with "." to include
+// subdomains - the prefix is stripped since we always match subdomains.
+type DomainSetRuleSource struct{}
+
+func (DomainSetRuleSource) Parse(r io.Reader) ([]Rule, error) {
+	scanner := bufio.NewScanner(r)
+
+	rules := make([]Rule, 0)
+
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+
+		if s == "" || strings.HasPrefix(s, "#") || strings.HasPrefix(s, "//") {
+			continue
+		}
+
+		site := strings.TrimPrefix(s, ".")
+		if domainRe.MatchString(site) {
+			rules = append(rules, Rule{Domain: site})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// PlaintextDomainRuleSource parses the simplest possible format: one bare
+// domain per line, no comments, no wildcards.
+type PlaintextDomainRuleSource struct{}
+
+func (PlaintextDomainRuleSource) Parse(r io.Reader) ([]Rule, error) {
+	scanner := bufio.NewScanner(r)
+
+	rules := make([]Rule, 0)
+
+	for scanner.Scan() {
+		site := strings.TrimSpace(scanner.Text())
+		if site == "" {
+			continue
+		}
+		if domainRe.MatchString(site) {
+			rules = append(rules, Rule{Domain: site})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
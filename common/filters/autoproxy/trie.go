@@ -0,0 +1,128 @@
+package autoproxy
+
+import (
+	"hash/fnv"
+	"strings"
+)
+
+// domainTrie is a reverse-label trie: "www.example.com" is inserted label
+// by label starting at the TLD ("com" -> "example" -> "www"), so a lookup
+// walks from TLD toward subdomain and can stop as soon as it falls off the
+// tree. Each node that terminates a rule carries the action for that rule;
+// the longest (deepest) match wins, which is what lets a more specific
+// exception rule (e.g. "foo.example.com") override a broader one
+// ("example.com").
+type domainTrie struct {
+	children  map[string]*domainTrie
+	action    Action
+	terminal  bool
+	exception bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+func reverseLabels(domain string) []string {
+	labels := strings.Split(strings.ToLower(strings.Trim(domain, ".")), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+func (t *domainTrie) insert(domain string, action Action, exception bool) {
+	node := t
+	for _, label := range reverseLabels(domain) {
+		if label == "" {
+			continue
+		}
+		child, ok := node.children[label]
+		if !ok {
+			child = newDomainTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.terminal = true
+	node.action = action
+	node.exception = exception
+}
+
+// lookup walks the trie from TLD toward subdomain, remembering the deepest
+// terminal node seen so a more specific rule overrides a less specific one.
+func (t *domainTrie) lookup(domain string) (action Action, exception, ok bool) {
+	node := t
+	for _, label := range reverseLabels(domain) {
+		child, exists := node.children[label]
+		if !exists {
+			break
+		}
+		node = child
+		if node.terminal {
+			action, exception, ok = node.action, node.exception, true
+		}
+	}
+	return action, exception, ok
+}
+
+// bloomFilter is a small counting Bloom filter used to cheaply reject
+// domains that cannot possibly be in the trie, so RoundTrip's hot path
+// skips the trie walk for the overwhelming majority of direct-bound
+// requests.
+type bloomFilter struct {
+	counts []uint8
+	k      int
+}
+
+func newBloomFilter(expectedItems int, k int) *bloomFilter {
+	size := expectedItems * 10
+	if size < 1<<10 {
+		size = 1 << 10
+	}
+	return &bloomFilter{counts: make([]uint8, size), k: k}
+}
+
+func (b *bloomFilter) hashes(s string) []uint32 {
+	h := make([]uint32, b.k)
+	for i := 0; i < b.k; i++ {
+		hasher := fnv.New32a()
+		hasher.Write([]byte{byte(i)})
+		hasher.Write([]byte(s))
+		h[i] = hasher.Sum32() % uint32(len(b.counts))
+	}
+	return h
+}
+
+func (b *bloomFilter) add(s string) {
+	for _, idx := range b.hashes(s) {
+		if b.counts[idx] < 255 {
+			b.counts[idx]++
+		}
+	}
+}
+
+// mightContain returns false only when s itself definitely was never
+// added - a true result is not a guarantee. Parent domains are not
+// tested here; see mightContainDomain.
+func (b *bloomFilter) mightContain(s string) bool {
+	for _, idx := range b.hashes(s) {
+		if b.counts[idx] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mightContainDomain tests every suffix of domain (the labels from the
+// rightmost one inward) against the filter, since a match can occur at
+// any ancestor domain.
+func (b *bloomFilter) mightContainDomain(domain string) bool {
+	labels := strings.Split(strings.ToLower(strings.Trim(domain, ".")), ".")
+	for i := 0; i < len(labels); i++ {
+		if b.mightContain(strings.Join(labels[i:], ".")) {
+			return true
+		}
+	}
+	return false
+}